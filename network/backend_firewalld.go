@@ -0,0 +1,199 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	firewalldBusName     = "org.fedoraproject.FirewallD1"
+	firewalldObjPath     = "/org/fedoraproject/FirewallD1"
+	firewalldDirectIface = firewalldBusName + ".direct"
+)
+
+// firewalldBackend implements FirewallBackend by adding flannel's rules to
+// firewalld's "direct" passthrough interface over D-Bus, so flannel doesn't
+// fight firewalld's own rule management on RHEL/Fedora hosts.
+type firewalldBackend struct {
+	obj dbus.BusObject
+}
+
+func newFirewalldBackend() (*firewalldBackend, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %v", err)
+	}
+	return &firewalldBackend{obj: conn.Object(firewalldBusName, firewalldObjPath)}, nil
+}
+
+func (b *firewalldBackend) Run(ctx context.Context, rules []FirewallRule, resyncPeriod time.Duration) error {
+	defer func() {
+		if err := b.Teardown(rules); err != nil {
+			log.Errorf("Failed to remove firewalld passthrough rules: %v", err)
+		}
+	}()
+
+	ensure := func() {
+		if err := b.ensure(rules); err != nil {
+			log.Errorf("Failed to ensure firewalld passthrough rules: %v", err)
+		}
+	}
+	ensure()
+
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			ensure()
+		}
+	}
+}
+
+func (b *firewalldBackend) ensure(rules []FirewallRule) error {
+	// firewalld's direct passthrough interface doesn't auto-create chains
+	// the way iptables-restore does; flannel's own FLANNEL-FORWARD/
+	// FLANNEL-INPUT/FLANNEL-DOCKER chains have to be added explicitly
+	// before any passthrough rule can jump to or populate them.
+	if err := b.ensureChains(rules); err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		ipv, args := firewalldPassthroughArgs(r)
+
+		var exists bool
+		if err := b.obj.Call(firewalldDirectIface+".queryPassthrough", 0, ipv, args).Store(&exists); err != nil {
+			return fmt.Errorf("failed to query passthrough rule: %v", err)
+		}
+		if exists {
+			continue
+		}
+
+		if call := b.obj.Call(firewalldDirectIface+".addPassthrough", 0, ipv, args); call.Err != nil {
+			return fmt.Errorf("failed to add passthrough rule: %v", call.Err)
+		}
+	}
+	return nil
+}
+
+// ensureChains creates the custom (non-builtin) chains rules reference,
+// mirroring createChainIfNotExists in the legacy backend.
+func (b *firewalldBackend) ensureChains(rules []FirewallRule) error {
+	for _, c := range customChains(rules) {
+		var exists bool
+		if err := b.obj.Call(firewalldDirectIface+".queryChain", 0, c.ipv, c.table, c.chain).Store(&exists); err != nil {
+			return fmt.Errorf("failed to query chain: %v", err)
+		}
+		if exists {
+			continue
+		}
+
+		if call := b.obj.Call(firewalldDirectIface+".addChain", 0, c.ipv, c.table, c.chain); call.Err != nil {
+			return fmt.Errorf("failed to add chain: %v", call.Err)
+		}
+	}
+	return nil
+}
+
+func (b *firewalldBackend) Teardown(rules []FirewallRule) error {
+	var firstErr error
+	for _, r := range rules {
+		ipv, args := firewalldPassthroughArgs(r)
+		// Ignore "rule doesn't exist" errors the same way the legacy
+		// backend ignores them from plain iptables -D; firewalld reports
+		// those as NOT_ENABLED.
+		call := b.obj.Call(firewalldDirectIface+".removePassthrough", 0, ipv, args)
+		if call.Err != nil && !strings.Contains(call.Err.Error(), "NOT_ENABLED") && firstErr == nil {
+			firstErr = call.Err
+		}
+	}
+
+	for _, c := range customChains(rules) {
+		// Same "ignore, it's already gone" reasoning as removePassthrough
+		// above.
+		b.obj.Call(firewalldDirectIface+".removeChain", 0, c.ipv, c.table, c.chain)
+	}
+
+	return firstErr
+}
+
+// firewalldChain identifies a custom chain by the same (family, table, name)
+// triple firewalld's direct interface keys chains on.
+type firewalldChain struct {
+	ipv, table, chain string
+}
+
+// customChains returns the deduplicated set of non-builtin chains rules
+// reference, in first-seen order — the ones firewalld doesn't create for us.
+func customChains(rules []FirewallRule) []firewalldChain {
+	seen := make(map[firewalldChain]bool)
+	var out []firewalldChain
+
+	for _, r := range rules {
+		chain := legacyChainName(r.Chain)
+		if isBuiltinChain(chain) {
+			continue
+		}
+
+		ipv := "ipv4"
+		if r.IPVersion == IPv6 {
+			ipv = "ipv6"
+		}
+
+		c := firewalldChain{ipv: ipv, table: legacyTableName(r.Table), chain: chain}
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		out = append(out, c)
+	}
+
+	return out
+}
+
+// firewalldPassthroughArgs renders r into firewalld's direct passthrough
+// format: an "ipv4"/"ipv6" family selector plus the raw iptables arguments,
+// reusing the legacy backend's table/chain/rulespec rendering since
+// passthrough rules are themselves plain iptables syntax.
+func firewalldPassthroughArgs(r FirewallRule) (string, []string) {
+	ipv := "ipv4"
+	if r.IPVersion == IPv6 {
+		ipv = "ipv6"
+	}
+
+	args := []string{"-t", legacyTableName(r.Table)}
+	if r.Pos != 0 {
+		args = append(args, "-I", legacyChainName(r.Chain), strconv.Itoa(r.Pos))
+	} else {
+		args = append(args, "-A", legacyChainName(r.Chain))
+	}
+	args = append(args, legacyRulespec(r)...)
+
+	return ipv, args
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// legacyBackend is the original go-iptables/ip6tables implementation of
+// FirewallBackend, kept as the default for hosts where nftables and
+// firewalld aren't in the picture.
+type legacyBackend struct{}
+
+func (legacyBackend) Run(ctx context.Context, rules []FirewallRule, resyncPeriod time.Duration) error {
+	r, err := newReconciler(LegacyRules(rules), resyncPeriod)
+	if err != nil {
+		return err
+	}
+	r.Run(ctx)
+	return nil
+}
+
+func (legacyBackend) Teardown(rules []FirewallRule) error {
+	return DeleteIPTables(LegacyRules(rules))
+}
+
+// RunWithMarkRules behaves like Run, additionally programming extra,
+// already-rendered legacy IPTablesRule such as the mangle-table rules
+// MarkRules returns for -egress-fwmark. Those aren't representable as a
+// backend-agnostic FirewallRule, so -egress-fwmark is wired through this
+// legacy-only entry point instead of Run's FirewallRule list; see
+// SetupAndEnsureFirewall.
+func (legacyBackend) RunWithMarkRules(ctx context.Context, rules []FirewallRule, resyncPeriod time.Duration, extra []IPTablesRule) error {
+	r, err := newReconciler(append(LegacyRules(rules), extra...), resyncPeriod)
+	if err != nil {
+		return err
+	}
+	r.Run(ctx)
+	return nil
+}
+
+// TeardownWithMarkRules is Teardown's counterpart to RunWithMarkRules.
+func (legacyBackend) TeardownWithMarkRules(rules []FirewallRule, extra []IPTablesRule) error {
+	return DeleteIPTables(append(LegacyRules(rules), extra...))
+}
+
+// LegacyRules translates backend-agnostic FirewallRule (as built by
+// MasqRules/ForwardRules/InputRules/PortForwardRules) into the
+// IPTablesRule/ip6tables rulespecs the legacy backend programs. Exported so
+// callers using the low-level SetupAndEnsureIPTables entry point directly
+// (instead of going through SetupAndEnsureFirewall's backend auto-detection)
+// can still compose it with those rule builders; append MarkRules' output
+// separately since it already returns IPTablesRule.
+func LegacyRules(rules []FirewallRule) []IPTablesRule {
+	out := make([]IPTablesRule, 0, len(rules))
+	for _, r := range rules {
+		out = append(out, IPTablesRule{
+			ipv:      r.IPVersion,
+			table:    legacyTableName(r.Table),
+			chain:    legacyChainName(r.Chain),
+			pos:      r.Pos,
+			rulespec: legacyRulespec(r),
+		})
+	}
+	return out
+}
+
+func legacyTableName(t Table) string {
+	if t == TableNAT {
+		return "nat"
+	}
+	return "filter"
+}
+
+func legacyChainName(c Chain) string {
+	switch c {
+	case ChainForward:
+		return "FORWARD"
+	case ChainInput:
+		return "INPUT"
+	case ChainPrerouting:
+		return "PREROUTING"
+	case ChainOutput:
+		return "OUTPUT"
+	case ChainPostrouting:
+		return "POSTROUTING"
+	case ChainFlannelForward:
+		return FlannelFwdChain
+	case ChainFlannelInput:
+		return FlannelInputChain
+	case ChainFlannelDNAT:
+		return FlannelDNATChain
+	default:
+		return ""
+	}
+}
+
+func legacyRulespec(r FirewallRule) []string {
+	var spec []string
+
+	if r.Source != "" {
+		if r.NotSource {
+			spec = append(spec, "!")
+		}
+		spec = append(spec, "-s", r.Source)
+	}
+
+	dest := r.Dest
+	if r.Multicast {
+		dest = r.multicastCIDR()
+	}
+	if dest != "" {
+		if r.NotDest {
+			spec = append(spec, "!")
+		}
+		spec = append(spec, "-d", dest)
+	}
+
+	if r.Proto != "" {
+		spec = append(spec, "-p", r.Proto)
+		if r.DPort != 0 {
+			spec = append(spec, "--dport", fmt.Sprintf("%d", r.DPort))
+		}
+	}
+
+	if r.Comment != "" {
+		spec = append(spec, "-m", "comment", "--comment", r.Comment)
+	}
+
+	switch r.Action {
+	case ActionReturn:
+		spec = append(spec, "-j", "RETURN")
+	case ActionAccept:
+		spec = append(spec, "-j", "ACCEPT")
+	case ActionMasquerade:
+		spec = append(spec, "-j", "MASQUERADE")
+		if r.RandomFully {
+			spec = append(spec, "--random-fully")
+		}
+	case ActionJump:
+		spec = append(spec, "-j", legacyChainName(r.Jump))
+	case ActionDNAT:
+		spec = append(spec, "-j", "DNAT", "--to-destination", r.DNATTo)
+	}
+
+	return spec
+}
@@ -0,0 +1,328 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+	"github.com/godbus/dbus/v5"
+)
+
+// backendFlag lets operators pin the firewall backend instead of relying on
+// auto-detection, e.g. when a host has both nft and iptables-legacy binaries
+// installed but only one is actually wired up to the running kernel.
+var backendFlag = flag.String("iptables-backend", "auto", "firewall backend to manage flannel's rules: auto, legacy, nft, or firewalld")
+
+// BackendKind identifies a concrete FirewallBackend implementation.
+type BackendKind string
+
+const (
+	BackendAuto      BackendKind = "auto"
+	BackendLegacy    BackendKind = "legacy"
+	BackendNFTables  BackendKind = "nft"
+	BackendFirewalld BackendKind = "firewalld"
+)
+
+// Action is the verdict a FirewallRule applies to matching traffic.
+type Action int
+
+const (
+	ActionAccept Action = iota
+	ActionReturn
+	ActionMasquerade
+	// ActionJump hands matching traffic to FirewallRule.Jump for further processing,
+	// e.g. the FORWARD/INPUT hooks jumping into flannel's own chains.
+	ActionJump
+	// ActionDNAT rewrites the destination to FirewallRule.DNATTo ("ip:port").
+	ActionDNAT
+)
+
+// Table is the backend-agnostic equivalent of an iptables table.
+type Table int
+
+const (
+	TableFilter Table = iota
+	TableNAT
+)
+
+// Chain identifies one of the fixed points a FirewallRule attaches to.
+type Chain int
+
+const (
+	ChainForward Chain = iota
+	ChainInput
+	ChainPrerouting
+	ChainOutput
+	ChainPostrouting
+	// ChainFlannelForward and ChainFlannelInput are flannel's own chains,
+	// hooked from ChainForward/ChainInput respectively.
+	ChainFlannelForward
+	ChainFlannelInput
+	// ChainFlannelDNAT holds PortForwardRules' per-hostPort DNAT rules,
+	// hooked from ChainPrerouting and ChainOutput.
+	ChainFlannelDNAT
+)
+
+// FirewallRule is a backend-agnostic match+action descriptor. MasqRules,
+// ForwardRules and InputRules build these; each FirewallBackend renders them
+// into whatever its underlying mechanism understands (iptables rulespecs,
+// nftables expressions, or firewalld passthrough rules).
+type FirewallRule struct {
+	IPVersion IPVersion
+	Table     Table
+	Chain     Chain
+	// Pos, if non-zero, inserts the rule at that 1-based position instead of
+	// appending it. Used for the FORWARD/INPUT jumps into flannel's chains so
+	// they're evaluated before rules other tools may have appended.
+	Pos int
+
+	// Source/Dest are CIDRs to match; NotSource/NotDest negate them. Either
+	// may be empty to mean "any".
+	Source    string
+	NotSource bool
+	Dest      string
+	NotDest   bool
+	Multicast bool // match traffic destined for the IP family's multicast range
+
+	// Proto/DPort optionally match on L4 protocol ("tcp"/"udp") and
+	// destination port; used by the port-forwarding DNAT rules. DPort is
+	// ignored unless Proto is set.
+	Proto string
+	DPort uint16
+
+	Comment string
+	Action  Action
+	// Jump names the chain ActionJump hands traffic to.
+	Jump Chain
+	// DNATTo is the "ip:port" ActionDNAT rewrites the destination to.
+	DNATTo string
+	// RandomFully requests MASQUERADE/SNAT port randomization, when the
+	// backend and kernel support it.
+	RandomFully bool
+}
+
+// multicastCIDR returns the match-all multicast range for the rule's IP family.
+func (r FirewallRule) multicastCIDR() string {
+	if r.IPVersion == IPv6 {
+		return "ff00::/8"
+	}
+	return "224.0.0.0/4"
+}
+
+// FirewallBackend programs and maintains a set of FirewallRule on the host.
+type FirewallBackend interface {
+	// Run programs rules and keeps them applied until ctx is cancelled, then
+	// tears them down. Implementations pick their own reconciliation strategy.
+	Run(ctx context.Context, rules []FirewallRule, resyncPeriod time.Duration) error
+	// Teardown removes rules without programming them first, for a clean
+	// shutdown when Run isn't (or is no longer) managing them.
+	Teardown(rules []FirewallRule) error
+}
+
+// MasqRules returns the rules that masquerade traffic leaving the overlay
+// network, for both the IPv4 subnet and, if the lease has one, the IPv6
+// subnet.
+func MasqRules(ipn ip.IP4Net, ip6n ip.IP6Net, lease *subnet.Lease) []FirewallRule {
+	n := ipn.String()
+	sn := lease.Subnet.String()
+	randomFully := supportsRandomFully()
+
+	rules := []FirewallRule{
+		// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
+		{IPVersion: IPv4, Table: TableNAT, Chain: ChainPostrouting, Source: n, Dest: n, Action: ActionReturn},
+		// NAT if it's not multicast traffic
+		{IPVersion: IPv4, Table: TableNAT, Chain: ChainPostrouting, Source: n, Dest: "", Multicast: true, NotDest: true, Action: ActionMasquerade, RandomFully: randomFully},
+		// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
+		{IPVersion: IPv4, Table: TableNAT, Chain: ChainPostrouting, Source: n, NotSource: true, Dest: sn, Action: ActionReturn},
+		// Masquerade anything headed towards flannel from the host
+		{IPVersion: IPv4, Table: TableNAT, Chain: ChainPostrouting, Source: n, NotSource: true, Dest: n, Action: ActionMasquerade, RandomFully: randomFully},
+	}
+
+	if lease.IPv6Subnet.Empty() {
+		return rules
+	}
+
+	n6 := ip6n.String()
+	sn6 := lease.IPv6Subnet.String()
+	return append(rules,
+		FirewallRule{IPVersion: IPv6, Table: TableNAT, Chain: ChainPostrouting, Source: n6, Dest: n6, Action: ActionReturn},
+		FirewallRule{IPVersion: IPv6, Table: TableNAT, Chain: ChainPostrouting, Source: n6, Multicast: true, NotDest: true, Action: ActionMasquerade, RandomFully: randomFully},
+		FirewallRule{IPVersion: IPv6, Table: TableNAT, Chain: ChainPostrouting, Source: n6, NotSource: true, Dest: sn6, Action: ActionReturn},
+		FirewallRule{IPVersion: IPv6, Table: TableNAT, Chain: ChainPostrouting, Source: n6, NotSource: true, Dest: n6, Action: ActionMasquerade, RandomFully: randomFully},
+	)
+}
+
+// ForwardRules returns the rules that let traffic to or from the flannel
+// network range be forwarded, for IPv4 and (if flannelIPv6Network is set)
+// IPv6.
+func ForwardRules(flannelNetwork string, flannelIPv6Network string) []FirewallRule {
+	rules := []FirewallRule{
+		{IPVersion: IPv4, Table: TableFilter, Chain: ChainForward, Pos: 1, Comment: "flannel forwarding rules", Action: ActionJump, Jump: ChainFlannelForward},
+		{IPVersion: IPv4, Table: TableFilter, Chain: ChainFlannelForward, Source: flannelNetwork, Action: ActionAccept},
+		{IPVersion: IPv4, Table: TableFilter, Chain: ChainFlannelForward, Dest: flannelNetwork, Action: ActionAccept},
+	}
+
+	if flannelIPv6Network == "" {
+		return rules
+	}
+
+	return append(rules,
+		FirewallRule{IPVersion: IPv6, Table: TableFilter, Chain: ChainForward, Pos: 1, Comment: "flannel forwarding rules", Action: ActionJump, Jump: ChainFlannelForward},
+		FirewallRule{IPVersion: IPv6, Table: TableFilter, Chain: ChainFlannelForward, Source: flannelIPv6Network, Action: ActionAccept},
+		FirewallRule{IPVersion: IPv6, Table: TableFilter, Chain: ChainFlannelForward, Dest: flannelIPv6Network, Action: ActionAccept},
+	)
+}
+
+// InputRules returns the rules that let traffic to the flannel network range
+// reach the host, for IPv4 and (if flannelIPv6Network is set) IPv6.
+func InputRules(flannelNetwork string, flannelIPv6Network string) []FirewallRule {
+	rules := []FirewallRule{
+		{IPVersion: IPv4, Table: TableFilter, Chain: ChainInput, Pos: 1, Comment: "flannel input rules", Action: ActionJump, Jump: ChainFlannelInput},
+		{IPVersion: IPv4, Table: TableFilter, Chain: ChainFlannelInput, Source: flannelNetwork, Action: ActionAccept},
+		{IPVersion: IPv4, Table: TableFilter, Chain: ChainFlannelInput, Dest: flannelNetwork, Action: ActionAccept},
+	}
+
+	if flannelIPv6Network == "" {
+		return rules
+	}
+
+	return append(rules,
+		FirewallRule{IPVersion: IPv6, Table: TableFilter, Chain: ChainInput, Pos: 1, Comment: "flannel input rules", Action: ActionJump, Jump: ChainFlannelInput},
+		FirewallRule{IPVersion: IPv6, Table: TableFilter, Chain: ChainFlannelInput, Source: flannelIPv6Network, Action: ActionAccept},
+		FirewallRule{IPVersion: IPv6, Table: TableFilter, Chain: ChainFlannelInput, Dest: flannelIPv6Network, Action: ActionAccept},
+	)
+}
+
+// DetectBackend resolves -iptables-backend into a concrete BackendKind,
+// probing the host when it's set to (or left at) "auto": prefer firewalld
+// when it owns the system bus name (so flannel doesn't fight firewalld's own
+// rule management on RHEL/Fedora), otherwise prefer nftables when the `nft`
+// binary is present and the system `iptables` binary is itself the
+// iptables-nft frontend, and fall back to the legacy go-iptables backend.
+func DetectBackend() BackendKind {
+	switch BackendKind(*backendFlag) {
+	case BackendLegacy, BackendNFTables, BackendFirewalld:
+		return BackendKind(*backendFlag)
+	}
+
+	if firewalldRunning() {
+		return BackendFirewalld
+	}
+	if nftablesAvailable() {
+		return BackendNFTables
+	}
+	return BackendLegacy
+}
+
+func firewalldRunning() bool {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+
+	var owned bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, "org.fedoraproject.FirewallD1").Store(&owned)
+	return err == nil && owned
+}
+
+func nftablesAvailable() bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+
+	out, err := exec.Command("iptables", "--version").CombinedOutput()
+	return err == nil && strings.Contains(string(out), "nf_tables")
+}
+
+func newFirewallBackend(kind BackendKind) (FirewallBackend, error) {
+	switch kind {
+	case BackendNFTables:
+		return newNFTablesBackend()
+	case BackendFirewalld:
+		return newFirewalldBackend()
+	default:
+		return &legacyBackend{}, nil
+	}
+}
+
+// SetupAndEnsureFirewall detects the right firewall backend for this host and
+// runs it until ctx is cancelled, tearing down its rules on the way out.
+// lease is consulted when -egress-fwmark is set, to scope the mangle-table
+// marking rules it adds to the lease's pod subnet(s), and by
+// PortForwardRules, which returns no rules when lease is nil; nil is only
+// safe when the flag is unset and portMappings is empty. -egress-fwmark currently only takes effect on the
+// legacy iptables backend (see MarkRules); on nft/firewalld it's logged and
+// ignored rather than silently dropped. portMappings, if any, are rendered
+// via PortForwardRules and merged into the programmed rule set; sourcing
+// them (e.g. from a lease annotation the CNI plugin populates) is the
+// caller's job, see PortMapping.
+func SetupAndEnsureFirewall(ctx context.Context, rules []FirewallRule, resyncPeriod int, lease *subnet.Lease, portMappings []PortMapping) error {
+	rules = append(rules, PortForwardRules(lease, portMappings)...)
+
+	kind := DetectBackend()
+	backend, err := newFirewallBackend(kind)
+	if err != nil {
+		return fmt.Errorf("failed to initialize %s firewall backend: %v", kind, err)
+	}
+
+	log.Infof("Using %s firewall backend", kind)
+
+	if mark := uint32(*egressFwmarkFlag); mark != 0 {
+		lb, ok := backend.(*legacyBackend)
+		switch {
+		case !ok:
+			log.Errorf("-egress-fwmark=%d is set but the %s firewall backend doesn't support it yet; no egress-marking rules will be programmed (use -iptables-backend=legacy for -egress-fwmark)", mark, kind)
+		case lease == nil:
+			log.Errorf("-egress-fwmark=%d is set but no lease was supplied; no egress-marking rules will be programmed", mark)
+		default:
+			return lb.RunWithMarkRules(ctx, rules, time.Duration(resyncPeriod)*time.Second, MarkRules(lease, mark))
+		}
+	}
+
+	return backend.Run(ctx, rules, time.Duration(resyncPeriod)*time.Second)
+}
+
+// DeleteFirewall removes rules using whichever backend this host would use,
+// without first (re-)programming them. lease and portMappings are only
+// consulted to reconstruct the egress-mark and port-forwarding rules
+// SetupAndEnsureFirewall would have added, so the same rules get torn down;
+// see SetupAndEnsureFirewall.
+func DeleteFirewall(rules []FirewallRule, lease *subnet.Lease, portMappings []PortMapping) error {
+	rules = append(rules, PortForwardRules(lease, portMappings)...)
+
+	kind := DetectBackend()
+	backend, err := newFirewallBackend(kind)
+	if err != nil {
+		return err
+	}
+
+	if mark := uint32(*egressFwmarkFlag); mark != 0 {
+		if lb, ok := backend.(*legacyBackend); ok {
+			return lb.TeardownWithMarkRules(rules, MarkRules(lease, mark))
+		}
+	}
+
+	return backend.Teardown(rules)
+}
@@ -16,21 +16,53 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"os/exec"
+	"strconv"
 	"strings"
 
 	log "github.com/golang/glog"
 
 	"time"
 
-	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
 )
 
+// safetyNetResyncPeriod is the resync interval the Reconciler falls back to
+// in addition to its event-driven triggers, in case a rule flush is missed
+// or netlink events are unavailable on the host. It's also a lower bound on
+// the ticker interval Reconciler.Run actually uses: a caller-supplied
+// resyncPeriod shorter than this (e.g. the legacy 5s polling interval older
+// callers still pass) is raised to it, so the ticker stops being the
+// day-to-day reconciliation mechanism and becomes what its name says.
+const safetyNetResyncPeriod = 5 * time.Minute
+
 const (
 	FlannelFwdChain   = "FLANNEL-FORWARD"
 	FlannelInputChain = "FLANNEL-INPUT"
+	// FlannelDNATChain holds the per-hostPort DNAT rules PortForwardRules
+	// generates, hooked from PREROUTING and OUTPUT. Named after libnetwork's
+	// DOCKER chain, which plays the same role for container port mapping.
+	FlannelDNATChain = "FLANNEL-DOCKER"
+)
+
+// egressFwmarkFlag lets operators have flannel fwmark traffic leaving the
+// local pod subnet, so it can be picked up by a hand-installed
+// `ip rule fwmark ... lookup <table>` for custom egress routing on nodes with
+// multiple uplinks or VRFs. 0 (the default) programs no marking rules.
+var egressFwmarkFlag = flag.Uint("egress-fwmark", 0, "fwmark to set on traffic leaving the local pod subnet, for custom policy routing (0 disables)")
+
+// IPVersion identifies which iptables family a rule belongs to.
+type IPVersion int
+
+const (
+	IPv4 IPVersion = iota
+	IPv6
 )
 
 type IPTables interface {
@@ -39,121 +71,236 @@ type IPTables interface {
 	Delete(table string, chain string, rulespec ...string) error
 	Exists(table string, chain string, rulespec ...string) (bool, error)
 	Insert(table, chain string, pos int, rulespec ...string) error
+	// Restore programs every rule in rules (already filtered to this
+	// client's IP version) in as few execs as possible.
+	//
+	// Deliberate deviation from the original request's Restore(tables
+	// map[string][]string) shape: taking the structured []IPTablesRule
+	// instead lets the loopRestore fallback replay the original rulespec
+	// []string directly instead of re-parsing rendered iptables-restore
+	// text (which is also what let a multi-word --comment value round-trip
+	// correctly; see loopRestore). Implementations that need the rendered
+	// text form (the real exec path) build it themselves via
+	// renderRestoreInput.
+	Restore(rules []IPTablesRule) error
 }
 
 type IPTablesRule struct {
+	ipv      IPVersion
 	table    string
 	chain    string
 	pos      int
 	rulespec []string
 }
 
-func MasqRules(ipn ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
-	n := ipn.String()
-	sn := lease.Subnet.String()
-	supports_random_fully := false
+// supportsRandomFully reports whether the local iptables binary understands
+// --random-fully, used by the legacy backend's masquerade rule rendering.
+func supportsRandomFully() bool {
 	ipt, err := iptables.New()
-	if err == nil {
-		supports_random_fully = ipt.HasRandomFully()
+	if err != nil {
+		return false
 	}
+	return ipt.HasRandomFully()
+}
 
-	if supports_random_fully {
-		return []IPTablesRule{
-			// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"-s", n, "-d", n, "-j", "RETURN"}},
-			// NAT if it's not multicast traffic
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE", "--random-fully"}},
-			// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"!", "-s", n, "-d", sn, "-j", "RETURN"}},
-			// Masquerade anything headed towards flannel from the host
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"!", "-s", n, "-d", n, "-j", "MASQUERADE", "--random-fully"}},
-		}
-	} else {
-		return []IPTablesRule{
-			// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"-s", n, "-d", n, "-j", "RETURN"}},
-			// NAT if it's not multicast traffic
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"-s", n, "!", "-d", "224.0.0.0/4", "-j", "MASQUERADE"}},
-			// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"!", "-s", n, "-d", sn, "-j", "RETURN"}},
-			// Masquerade anything headed towards flannel from the host
-			{table: "nat", chain: "POSTROUTING", rulespec: []string{"!", "-s", n, "-d", n, "-j", "MASQUERADE"}},
-		}
+// SetupAndEnsureIPTables programs rules via the iptables client matching each
+// rule's IPVersion, using ip6tables for IPv6 rules so dual-stack clusters get
+// masquerading and forwarding for both families. If -egress-fwmark is set,
+// lease's egress MARK/CONNMARK rules are added to the set. It builds a
+// Reconciler and runs it until the process exits.
+//
+// This is the low-level, legacy-iptables-only entry point, so rules must
+// already be []IPTablesRule; callers building them from the backend-agnostic
+// MasqRules/ForwardRules/InputRules/PortForwardRules generators should pass
+// them through LegacyRules first. Callers going through the pluggable
+// backends added by DetectBackend should use SetupAndEnsureFirewall instead,
+// which only applies -egress-fwmark when the legacy backend is in play
+// (mangle-table MARK/CONNMARK rules have no nft/firewalld equivalent yet).
+func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int, lease *subnet.Lease) {
+	if mark := uint32(*egressFwmarkFlag); mark != 0 {
+		rules = append(rules, MarkRules(lease, mark)...)
 	}
-}
 
-func ForwardRules(flannelNetwork string) []IPTablesRule {
-	return []IPTablesRule{
-		// These rules allow traffic to be forwarded if it is to or from the flannel network range.
-		{table: "filter", chain: "FORWARD", pos: 1, rulespec: []string{"-m", "comment", "--comment", "flannel forwarding rules", "-j", FlannelFwdChain}},
-		{table: "filter", chain: FlannelFwdChain, rulespec: []string{"-s", flannelNetwork, "-j", "ACCEPT"}},
-		{table: "filter", chain: FlannelFwdChain, rulespec: []string{"-d", flannelNetwork, "-j", "ACCEPT"}},
+	r, err := newReconciler(rules, time.Duration(resyncPeriod)*time.Second)
+	if err != nil {
+		log.Errorf("Failed to setup IPTables. iptables binary was not found: %v", err)
+		return
 	}
+	r.Run(context.Background())
 }
 
-func InputRules(flannelNetwork string) []IPTablesRule {
-	return []IPTablesRule{
-		// These rules allow traffic to come to the flannel network range.
-		{table: "filter", chain: "INPUT", pos: 1, rulespec: []string{"-m", "comment", "--comment", "flannel input rules", "-j", FlannelInputChain}},
-		{table: "filter", chain: FlannelInputChain, rulespec: []string{"-s", flannelNetwork, "-j", "ACCEPT"}},
-		{table: "filter", chain: FlannelInputChain, rulespec: []string{"-d", flannelNetwork, "-j", "ACCEPT"}},
+// MarkRules returns the mangle-table rules that fwmark traffic sourced from
+// the local pod subnet (IPv4 and, if the lease has one, IPv6), plus the
+// CONNMARK save-mark/restore-mark pair that keeps the rest of a connection's
+// packets (including return traffic) carrying the same mark once the
+// conntrack entry has it. restore-mark comes before the plain MARK rule in
+// PREROUTING so packets of an already-marked connection that don't come from
+// the pod subnet (such as return traffic) get the mark back; save-mark runs last in POSTROUTING so the mark set in PREROUTING/OUTPUT is
+// what gets persisted.
+func MarkRules(lease *subnet.Lease, mark uint32) []IPTablesRule {
+	if mark == 0 || lease == nil {
+		return nil
 	}
-}
 
-func ipTablesRulesExist(ipt IPTables, rules []IPTablesRule) (bool, error) {
-	for _, rule := range rules {
-		exists, err := ipt.Exists(rule.table, rule.chain, rule.rulespec...)
-		if err != nil {
-			// this shouldn't ever happen
-			return false, fmt.Errorf("failed to check rule existence: %v", err)
-		}
-		if !exists {
-			return false, nil
+	setXmark := fmt.Sprintf("0x%x/0xffffffff", mark)
+
+	markRules := func(ipv IPVersion, sn string) []IPTablesRule {
+		return []IPTablesRule{
+			{ipv: ipv, table: "mangle", chain: "PREROUTING", rulespec: []string{"-m", "connmark", "!", "--mark", "0x0/0xffffffff", "-j", "CONNMARK", "--restore-mark"}},
+			{ipv: ipv, table: "mangle", chain: "PREROUTING", rulespec: []string{"-s", sn, "-j", "MARK", "--set-xmark", setXmark}},
+			{ipv: ipv, table: "mangle", chain: "OUTPUT", rulespec: []string{"-s", sn, "-j", "MARK", "--set-xmark", setXmark}},
+			{ipv: ipv, table: "mangle", chain: "POSTROUTING", rulespec: []string{"-s", sn, "-j", "CONNMARK", "--save-mark"}},
 		}
 	}
 
-	return true, nil
+	rules := markRules(IPv4, lease.Subnet.String())
+
+	if lease.IPv6Subnet.Empty() {
+		return rules
+	}
+	return append(rules, markRules(IPv6, lease.IPv6Subnet.String())...)
 }
 
-func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
-	ipt, err := iptables.New()
+// newReconciler builds a Reconciler backed by the IPv4 (and, if available,
+// IPv6) iptables/ip6tables clients, for callers that need to drive its Run
+// loop against their own context.
+func newReconciler(rules []IPTablesRule, resyncPeriod time.Duration) (*Reconciler, error) {
+	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		// if we can't find iptables, give up and return
-		log.Errorf("Failed to setup IPTables. iptables binary was not found: %v", err)
-		return
+		return nil, err
+	}
+
+	ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		// ip6tables is optional; dual-stack rules are simply skipped if it's unavailable
+		log.Infof("ip6tables not available, IPv6 rules will not be programmed: %v", err)
+		ipt6 = nil
 	}
 
-	defer func() {
-		teardownIPTables(ipt, rules)
-	}()
+	clients := ipTablesClients{v4: newRestoreIPTables(ipt4, "iptables-restore")}
+	if ipt6 != nil {
+		clients.v6 = newRestoreIPTables(ipt6, "ip6tables-restore")
+	}
 
-	for {
-		// Ensure that all the iptables rules exist every 5 seconds
-		if err := ensureIPTables(ipt, rules); err != nil {
+	return &Reconciler{clients: clients, rules: rules, resyncPeriod: resyncPeriod}, nil
+}
+
+// Reconciler keeps a set of IPTablesRule programmed on the host. Instead of
+// polling on a fixed timer, it reconciles on link/address changes reported
+// over netlink, which catches most of the events that cause rules to go
+// missing in practice (interfaces and addresses coming and going), while
+// still falling back to a long safety-net resync in case an event is missed.
+// Note this does not subscribe to netfilter table-change notifications, so a
+// bare `iptables -F` with no accompanying link/address change is only
+// repaired on the next safety-net resync, not immediately.
+type Reconciler struct {
+	clients      ipTablesClients
+	rules        []IPTablesRule
+	resyncPeriod time.Duration
+}
+
+// Run programs the rules and then reconciles them until ctx is cancelled,
+// tearing them down on the way out.
+func (r *Reconciler) Run(ctx context.Context) {
+	defer teardownIPTables(r.clients, r.rules)
+
+	// Raise the ticker to at least safetyNetResyncPeriod: callers still pass
+	// the old 5s-ish polling interval, and letting that through as-is would
+	// have the netlink-triggered reconciles merely add to the same
+	// steady-state iptables -C volume instead of replacing it with a long
+	// safety net plus event-driven repairs.
+	resyncPeriod := r.resyncPeriod
+	if resyncPeriod < safetyNetResyncPeriod {
+		resyncPeriod = safetyNetResyncPeriod
+	}
+
+	linkCh := make(chan netlink.LinkUpdate)
+	addrCh := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	defer close(done)
+
+	if err := netlink.LinkSubscribe(linkCh, done); err != nil {
+		log.Errorf("Failed to subscribe to link updates, falling back to periodic resync only: %v", err)
+	}
+	if err := netlink.AddrSubscribe(addrCh, done); err != nil {
+		log.Errorf("Failed to subscribe to address updates, falling back to periodic resync only: %v", err)
+	}
+
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+
+	reconcile := func() {
+		if err := r.ensureIPTables(); err != nil {
 			log.Errorf("Failed to ensure iptables rules: %v", err)
 		}
+	}
+
+	// Program the rules immediately instead of waiting for the first tick or event.
+	reconcile()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-linkCh:
+			reconcile()
+		case <-addrCh:
+			reconcile()
+		case <-ticker.C:
+			reconcile()
+		}
+	}
+}
 
-		time.Sleep(time.Duration(resyncPeriod) * time.Second)
+// ipTablesClients bundles the IPv4 and IPv6 iptables clients so callers can
+// dispatch each rule to the client matching its IPVersion. v6 is nil when
+// ip6tables isn't available on the host, in which case IPv6 rules are skipped.
+type ipTablesClients struct {
+	v4 IPTables
+	v6 IPTables
+}
+
+func (c ipTablesClients) forRule(rule IPTablesRule) IPTables {
+	if rule.ipv == IPv6 {
+		return c.v6
 	}
+	return c.v4
 }
 
 // DeleteIPTables delete specified iptables rules
 func DeleteIPTables(rules []IPTablesRule) error {
-	ipt, err := iptables.New()
+	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		// if we can't find iptables, give up and return
 		log.Errorf("Failed to setup IPTables. iptables binary was not found: %v", err)
 		return err
 	}
-	teardownIPTables(ipt, rules)
+	ipt6, _ := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+
+	clients := ipTablesClients{v4: newRestoreIPTables(ipt4, "iptables-restore")}
+	if ipt6 != nil {
+		clients.v6 = newRestoreIPTables(ipt6, "ip6tables-restore")
+	}
+
+	teardownIPTables(clients, rules)
 	return nil
 }
 
-func ensureIPTables(ipt IPTables, rules []IPTablesRule) error {
+// ensureIPTables checks that all of the Reconciler's rules exist and,
+// if not, recreates the full rule set. It's a method so tests can drive it
+// directly against a fake IPTables implementation without going through Run.
+func (r *Reconciler) ensureIPTables() error {
+	clients, rules := r.clients, r.rules
+
 	// Below we create uniq chains if they not exist yet
 	tableChainUniqMap := make(map[string]struct{})
 	for _, rule := range rules {
-		tableChainKey := fmt.Sprintf("%s-%s", rule.table, rule.chain)
+		ipt := clients.forRule(rule)
+		if ipt == nil {
+			continue
+		}
+		tableChainKey := fmt.Sprintf("%d-%s-%s", rule.ipv, rule.table, rule.chain)
 		if _, ok := tableChainUniqMap[tableChainKey]; !ok {
 			if err := createChainIfNotExists(ipt, rule.table, rule.chain); err != nil {
 				return err
@@ -162,7 +309,7 @@ func ensureIPTables(ipt IPTables, rules []IPTablesRule) error {
 		}
 	}
 
-	exists, err := ipTablesRulesExist(ipt, rules)
+	exists, err := ipTablesRulesExistForClients(clients, rules)
 	if err != nil {
 		return fmt.Errorf("Error checking rule existence: %v", err)
 	}
@@ -175,13 +322,31 @@ func ensureIPTables(ipt IPTables, rules []IPTablesRule) error {
 	// We do this because the order of the rules is important
 	log.Info("Some iptables rules are missing; deleting and recreating rules")
 
-	teardownIPTables(ipt, rules)
-	if err = setupIPTables(ipt, rules); err != nil {
+	teardownIPTables(clients, rules)
+	if err = setupIPTables(clients, rules); err != nil {
 		return fmt.Errorf("Error setting up rules: %v", err)
 	}
 	return nil
 }
 
+func ipTablesRulesExistForClients(clients ipTablesClients, rules []IPTablesRule) (bool, error) {
+	for _, rule := range rules {
+		ipt := clients.forRule(rule)
+		if ipt == nil {
+			continue
+		}
+		exists, err := ipt.Exists(rule.table, rule.chain, rule.rulespec...)
+		if err != nil {
+			return false, fmt.Errorf("failed to check rule existence: %v", err)
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 func createChainIfNotExists(ipt IPTables, table string, chain string) error {
 	if err := ipt.NewChain(table, chain); err != nil {
 		// Exit code 1 means the chain already exists
@@ -195,16 +360,106 @@ func createChainIfNotExists(ipt IPTables, table string, chain string) error {
 	return nil
 }
 
-func setupIPTables(ipt IPTables, rules []IPTablesRule) error {
-	if err := appendRulesUniq(ipt, rules); err != nil {
-		return err
+// setupIPTables programs the full rule set for each protocol in a single
+// Restore call per client, instead of one Exists/Insert/AppendUnique exec
+// per rule.
+func setupIPTables(clients ipTablesClients, rules []IPTablesRule) error {
+	if clients.v4 != nil {
+		if err := clients.v4.Restore(rulesForVersion(rules, IPv4)); err != nil {
+			return fmt.Errorf("failed to restore iptables rules: %v", err)
+		}
+	}
+	if clients.v6 != nil {
+		if err := clients.v6.Restore(rulesForVersion(rules, IPv6)); err != nil {
+			return fmt.Errorf("failed to restore ip6tables rules: %v", err)
+		}
 	}
 
 	return nil
 }
 
-func teardownIPTables(ipt IPTables, rules []IPTablesRule) {
+// rulesForVersion returns the subset of rules matching ipv, preserving order.
+func rulesForVersion(rules []IPTablesRule, ipv IPVersion) []IPTablesRule {
+	var out []IPTablesRule
+	for _, rule := range rules {
+		if rule.ipv == ipv {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+// renderRestoreInput renders rules (already filtered to one IP family) into
+// iptables-restore's "*table" / ":chain - [0:0]" / "-A"/"-I" / "COMMIT"
+// input format, grouping rules by table in first-seen order.
+func renderRestoreInput(rules []IPTablesRule) string {
+	var buf bytes.Buffer
+
+	var tableOrder []string
+	byTable := make(map[string][]IPTablesRule)
 	for _, rule := range rules {
+		if _, ok := byTable[rule.table]; !ok {
+			tableOrder = append(tableOrder, rule.table)
+		}
+		byTable[rule.table] = append(byTable[rule.table], rule)
+	}
+
+	for _, table := range tableOrder {
+		fmt.Fprintf(&buf, "*%s\n", table)
+
+		declaredChains := make(map[string]bool)
+		for _, rule := range byTable[table] {
+			if !isBuiltinChain(rule.chain) && !declaredChains[rule.chain] {
+				fmt.Fprintf(&buf, ":%s - [0:0]\n", rule.chain)
+				declaredChains[rule.chain] = true
+			}
+		}
+
+		for _, rule := range byTable[table] {
+			if rule.pos != 0 {
+				fmt.Fprintf(&buf, "-I %s %d %s\n", rule.chain, rule.pos, restoreRulespec(rule.rulespec))
+			} else {
+				fmt.Fprintf(&buf, "-A %s %s\n", rule.chain, restoreRulespec(rule.rulespec))
+			}
+		}
+
+		buf.WriteString("COMMIT\n")
+	}
+
+	return buf.String()
+}
+
+// restoreRulespec joins rulespec into iptables-restore's single-line rule
+// syntax, double-quoting any element (e.g. a multi-word --comment value)
+// that contains whitespace so iptables-restore doesn't split it into
+// multiple arguments.
+func restoreRulespec(rulespec []string) string {
+	quoted := make([]string, len(rulespec))
+	for i, field := range rulespec {
+		if strings.ContainsAny(field, " \t") {
+			quoted[i] = strconv.Quote(field)
+		} else {
+			quoted[i] = field
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func isBuiltinChain(chain string) bool {
+	switch chain {
+	case "PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING":
+		return true
+	default:
+		return false
+	}
+}
+
+func teardownIPTables(clients ipTablesClients, rules []IPTablesRule) {
+	for _, rule := range rules {
+		ipt := clients.forRule(rule)
+		if ipt == nil {
+			continue
+		}
 		log.Info("Deleting iptables rule: ", strings.Join(rule.rulespec, " "))
 		// We ignore errors here because if there's an error it's almost certainly because the rule
 		// doesn't exist, which is fine (we don't need to delete rules that don't exist)
@@ -212,28 +467,74 @@ func teardownIPTables(ipt IPTables, rules []IPTablesRule) {
 	}
 }
 
-func appendRulesUniq(ipt IPTables, rules []IPTablesRule) error {
+// restoreIPTables wraps a *iptables.IPTables client and adds batched
+// programming via "<bin> --noflush", so setupIPTables can push a whole rule
+// set in one exec instead of one Exists/Insert/AppendUnique call per rule.
+// When the restore binary isn't on PATH, Restore falls back to looping over
+// the same rules with the wrapped client's existing primitives.
+type restoreIPTables struct {
+	*iptables.IPTables
+	bin string
+}
+
+func newRestoreIPTables(ipt *iptables.IPTables, bin string) *restoreIPTables {
+	return &restoreIPTables{IPTables: ipt, bin: bin}
+}
+
+func (w *restoreIPTables) Restore(rules []IPTablesRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	if _, err := exec.LookPath(w.bin); err != nil {
+		log.Infof("%s not found, falling back to per-rule iptables calls: %v", w.bin, err)
+		return loopRestore(w.IPTables, rules)
+	}
+
+	cmd := exec.Command(w.bin, "--noflush")
+	cmd.Stdin = strings.NewReader(renderRestoreInput(rules))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", w.bin, err, out)
+	}
+	return nil
+}
+
+// loopRestore applies the same rules one exec at a time, for hosts where the
+// batch restore binary isn't available. It works directly off the original
+// IPTablesRule rulespecs, so multi-word rulespec elements (e.g. a
+// --comment value) are never re-split the way a re-parsed restore line
+// would split them.
+func loopRestore(ipt IPTables, rules []IPTablesRule) error {
+	declaredChains := make(map[string]bool)
+
 	for _, rule := range rules {
+		chainKey := rule.table + "/" + rule.chain
+		if !isBuiltinChain(rule.chain) && !declaredChains[chainKey] {
+			if err := createChainIfNotExists(ipt, rule.table, rule.chain); err != nil {
+				return err
+			}
+			declaredChains[chainKey] = true
+		}
+
 		if rule.pos != 0 {
-			log.Info("Inserting iptables rule: ", strings.Join(rule.rulespec, " "))
 			exists, err := ipt.Exists(rule.table, rule.chain, rule.rulespec...)
 			if err != nil {
 				return fmt.Errorf("failed to insert IPTables rule: %v", err)
 			}
-
 			if exists {
 				continue
 			}
 
+			log.Info("Inserting iptables rule: ", strings.Join(rule.rulespec, " "))
 			if err := ipt.Insert(rule.table, rule.chain, rule.pos, rule.rulespec...); err != nil {
 				return fmt.Errorf("failed to insert IPTables rule: %v", err)
 			}
-		} else {
-			log.Info("Appending iptables rule: ", strings.Join(rule.rulespec, " "))
-			err := ipt.AppendUnique(rule.table, rule.chain, rule.rulespec...)
-			if err != nil {
-				return fmt.Errorf("failed to insert IPTables rule: %v", err)
-			}
+			continue
+		}
+
+		log.Info("Appending iptables rule: ", strings.Join(rule.rulespec, " "))
+		if err := ipt.AppendUnique(rule.table, rule.chain, rule.rulespec...); err != nil {
+			return fmt.Errorf("failed to append IPTables rule: %v", err)
 		}
 	}
 	return nil
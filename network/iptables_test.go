@@ -0,0 +1,175 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeIPTables is a minimal in-memory IPTables for exercising the Reconciler
+// without shelling out to a real iptables binary.
+type fakeIPTables struct {
+	chains   map[string]bool
+	existing map[string]bool
+	restores int
+}
+
+func newFakeIPTables() *fakeIPTables {
+	return &fakeIPTables{chains: map[string]bool{}, existing: map[string]bool{}}
+}
+
+func ruleKey(table, chain string, rulespec ...string) string {
+	return table + "/" + chain + "/" + strings.Join(rulespec, " ")
+}
+
+func (f *fakeIPTables) NewChain(table, chain string) error {
+	f.chains[table+"/"+chain] = true
+	return nil
+}
+
+func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	f.existing[ruleKey(table, chain, rulespec...)] = true
+	return nil
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	delete(f.existing, ruleKey(table, chain, rulespec...))
+	return nil
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return f.existing[ruleKey(table, chain, rulespec...)], nil
+}
+
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.existing[ruleKey(table, chain, rulespec...)] = true
+	return nil
+}
+
+func (f *fakeIPTables) Restore(rules []IPTablesRule) error {
+	f.restores++
+	for _, rule := range rules {
+		f.existing[ruleKey(rule.table, rule.chain, rule.rulespec...)] = true
+	}
+	return nil
+}
+
+func TestReconcilerEnsureIPTablesRecreatesMissingRules(t *testing.T) {
+	v4 := newFakeIPTables()
+	rules := []IPTablesRule{
+		{ipv: IPv4, table: "filter", chain: "FORWARD", pos: 1, rulespec: []string{"-j", "FLANNEL-FORWARD"}},
+		{ipv: IPv4, table: "filter", chain: FlannelFwdChain, rulespec: []string{"-s", "10.1.0.0/16", "-j", "ACCEPT"}},
+	}
+
+	r := &Reconciler{clients: ipTablesClients{v4: v4}, rules: rules}
+
+	if err := r.ensureIPTables(); err != nil {
+		t.Fatalf("ensureIPTables: %v", err)
+	}
+	if v4.restores != 1 {
+		t.Fatalf("expected ensureIPTables to (re)program missing rules via Restore once, got %d calls", v4.restores)
+	}
+	for _, rule := range rules {
+		if !v4.existing[ruleKey(rule.table, rule.chain, rule.rulespec...)] {
+			t.Errorf("rule %v was not programmed", rule.rulespec)
+		}
+	}
+
+	// All rules already exist: ensureIPTables should be a no-op, not tear
+	// down and reprogram.
+	if err := r.ensureIPTables(); err != nil {
+		t.Fatalf("ensureIPTables: %v", err)
+	}
+	if v4.restores != 1 {
+		t.Fatalf("expected no additional Restore call when all rules already exist, got %d total calls", v4.restores)
+	}
+}
+
+func TestReconcilerEnsureIPTablesDispatchesByIPVersion(t *testing.T) {
+	v4 := newFakeIPTables()
+	v6 := newFakeIPTables()
+	rules := []IPTablesRule{
+		{ipv: IPv4, table: "nat", chain: "POSTROUTING", rulespec: []string{"-s", "10.1.0.0/16", "-j", "MASQUERADE"}},
+		{ipv: IPv6, table: "nat", chain: "POSTROUTING", rulespec: []string{"-s", "fc00::/48", "-j", "MASQUERADE"}},
+	}
+
+	r := &Reconciler{clients: ipTablesClients{v4: v4, v6: v6}, rules: rules}
+
+	if err := r.ensureIPTables(); err != nil {
+		t.Fatalf("ensureIPTables: %v", err)
+	}
+
+	if !v4.existing[ruleKey("nat", "POSTROUTING", "-s", "10.1.0.0/16", "-j", "MASQUERADE")] {
+		t.Error("IPv4 rule was not programmed on the v4 client")
+	}
+	if v4.existing[ruleKey("nat", "POSTROUTING", "-s", "fc00::/48", "-j", "MASQUERADE")] {
+		t.Error("IPv6 rule leaked onto the v4 client")
+	}
+	if !v6.existing[ruleKey("nat", "POSTROUTING", "-s", "fc00::/48", "-j", "MASQUERADE")] {
+		t.Error("IPv6 rule was not programmed on the v6 client")
+	}
+}
+
+func TestRenderRestoreInputQuotesMultiWordRulespecValues(t *testing.T) {
+	rules := []IPTablesRule{
+		{table: "filter", chain: "FORWARD", pos: 1, rulespec: []string{"-m", "comment", "--comment", "flannel forwarding rules", "-j", FlannelFwdChain}},
+		{table: "filter", chain: FlannelFwdChain, rulespec: []string{"-s", "10.1.0.0/16", "-j", "ACCEPT"}},
+	}
+
+	got := renderRestoreInput(rules)
+	want := "*filter\n" +
+		":" + FlannelFwdChain + " - [0:0]\n" +
+		`-I FORWARD 1 -m comment --comment "flannel forwarding rules" -j ` + FlannelFwdChain + "\n" +
+		"-A " + FlannelFwdChain + " -s 10.1.0.0/16 -j ACCEPT\n" +
+		"COMMIT\n"
+
+	if got != want {
+		t.Errorf("renderRestoreInput mismatch:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestLoopRestorePreservesMultiWordRulespecValues(t *testing.T) {
+	ipt := newFakeIPTables()
+	rules := []IPTablesRule{
+		{table: "filter", chain: "FORWARD", pos: 1, rulespec: []string{"-m", "comment", "--comment", "flannel forwarding rules", "-j", FlannelFwdChain}},
+	}
+
+	if err := loopRestore(ipt, rules); err != nil {
+		t.Fatalf("loopRestore: %v", err)
+	}
+
+	if !ipt.existing[ruleKey("filter", "FORWARD", rules[0].rulespec...)] {
+		t.Error("loopRestore did not program the rule with its comment kept as a single rulespec element")
+	}
+}
+
+func TestReconcilerEnsureIPTablesSkipsIPv6WhenClientUnavailable(t *testing.T) {
+	v4 := newFakeIPTables()
+	rules := []IPTablesRule{
+		{ipv: IPv4, table: "filter", chain: "FORWARD", rulespec: []string{"-j", "ACCEPT"}},
+		{ipv: IPv6, table: "filter", chain: "FORWARD", rulespec: []string{"-j", "ACCEPT"}},
+	}
+
+	r := &Reconciler{clients: ipTablesClients{v4: v4}, rules: rules}
+
+	if err := r.ensureIPTables(); err != nil {
+		t.Fatalf("ensureIPTables: %v", err)
+	}
+	if !v4.existing[ruleKey("filter", "FORWARD", "-j", "ACCEPT")] {
+		t.Error("IPv4 rule was not programmed")
+	}
+}
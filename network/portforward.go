@@ -0,0 +1,91 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"fmt"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// PortMapping is a single hostPort->podIP:containerPort mapping to be DNAT'd
+// to a pod in the local lease. SetupAndEnsureFirewall/DeleteFirewall accept
+// these directly and wire them through PortForwardRules; sourcing them is
+// the caller's job. The idea is for the CNI plugin (or another agent acting
+// on its behalf) to record them somewhere flannel can read back, e.g. a
+// lease annotation, so flannel can program them without a separate portmap
+// CNI plugin — but subnet.Lease/subnet.LeaseAttrs live outside this package
+// and aren't extended here to carry them, so the caller has to do that
+// lookup itself and pass the result in.
+type PortMapping struct {
+	HostPort      uint16
+	ContainerPort uint16
+	// Protocol is "tcp" or "udp".
+	Protocol string
+	PodIP    string
+}
+
+// PortForwardRules returns the rules that DNAT traffic for each mapping to
+// its pod, hooked from both PREROUTING (traffic arriving over the wire) and
+// OUTPUT (traffic originating on the host itself, e.g. a local client
+// hitting a NodePort), plus a same-host hairpin MASQUERADE rule so a pod in
+// the local lease can reach the target pod through this node's hostPort. This mirrors
+// libnetwork's port_mapping + DOCKER chain design.
+func PortForwardRules(lease *subnet.Lease, mappings []PortMapping) []FirewallRule {
+	if len(mappings) == 0 || lease == nil {
+		return nil
+	}
+
+	sn := lease.Subnet.String()
+	rules := []FirewallRule{
+		{Table: TableNAT, Chain: ChainPrerouting, Pos: 1, Comment: "flannel port forwarding rules", Action: ActionJump, Jump: ChainFlannelDNAT},
+		{Table: TableNAT, Chain: ChainOutput, Pos: 1, Comment: "flannel port forwarding rules", Action: ActionJump, Jump: ChainFlannelDNAT},
+	}
+
+	for _, m := range mappings {
+		rules = append(rules,
+			FirewallRule{
+				Table:  TableNAT,
+				Chain:  ChainFlannelDNAT,
+				Proto:  m.Protocol,
+				DPort:  m.HostPort,
+				Action: ActionDNAT,
+				DNATTo: fmt.Sprintf("%s:%d", m.PodIP, m.ContainerPort),
+			},
+			// Hairpin: when another pod on the overlay addresses this
+			// node's hostPort, the DNAT above leaves the packet's source
+			// inside the pod subnet and rewrites its destination to the
+			// target pod's IP — same-subnet traffic the target pod would
+			// reply to directly, bypassing the node the source pod expects
+			// its reply from. Masquerade it as coming from the node so the
+			// reply still passes back through the DNAT above. This doesn't
+			// cover a client process on the node itself addressing its own
+			// hostPort (its source is the node's address, not sn), which
+			// needs no such rewrite since it's already outside sn.
+			FirewallRule{
+				Table:  TableNAT,
+				Chain:  ChainPostrouting,
+				Source: sn,
+				Dest:   m.PodIP + "/32",
+				Proto:  m.Protocol,
+				DPort:  m.ContainerPort,
+				Action: ActionMasquerade,
+			},
+		)
+	}
+
+	return rules
+}